@@ -0,0 +1,330 @@
+package fse
+
+import (
+	"fmt"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	blockRaw byte = iota
+	blockRLE
+	blockCompressed
+)
+
+// defaultMaxDecompressedSize is the output size Decompress will allocate for
+// a Scratch whose MaxDecompressedSize is unset. The decompressed length is
+// read straight out of the untrusted input, so without a bound a handful of
+// crafted bytes can make Decompress try to allocate gigabytes.
+const defaultMaxDecompressedSize = 128 << 20 // 128MiB
+
+// maxDecompressedSize returns the allocation bound Decompress should enforce
+// for s.
+func (s *Scratch) maxDecompressedSize() int {
+	if s.MaxDecompressedSize > 0 {
+		return s.MaxDecompressedSize
+	}
+	return defaultMaxDecompressedSize
+}
+
+// decSymbol is one entry of the decoding table built by buildDTable: the
+// symbol that owns this state slot, how many bits to read to move on, and
+// the state (already offset by the bits that will be read) to move to.
+type decSymbol struct {
+	newState uint16
+	nbBits   uint8
+	symbol   byte
+}
+
+// dTable holds the decoding table built by buildDTable. It is kept separate
+// from cTable since decode only ever runs against a freshly parsed header.
+type dTable struct {
+	table []decSymbol
+}
+
+// headerReader is a plain LSB-first forward bit reader, used to parse the
+// NCount header written by writeCount. Unlike the FSE bitstream itself, the
+// header is read front-to-back in the same order it was written.
+type headerReader struct {
+	in     []byte
+	bitPos int
+}
+
+func (r *headerReader) peekBits(n uint) (uint32, error) {
+	var v uint32
+	for i := uint(0); i < n; i++ {
+		pos := r.bitPos + int(i)
+		byteIdx := pos / 8
+		if byteIdx >= len(r.in) {
+			return 0, errors.New("fse: NCount header truncated")
+		}
+		bit := (r.in[byteIdx] >> uint(pos%8)) & 1
+		v |= uint32(bit) << i
+	}
+	return v, nil
+}
+
+func (r *headerReader) readBits(n uint) (uint32, error) {
+	v, err := r.peekBits(n)
+	if err != nil {
+		return 0, err
+	}
+	r.bitPos += int(n)
+	return v, nil
+}
+
+// ReadNCount parses the normalized-count header written by writeCount back
+// into s.norm and s.actualTableLog, reversing its threshold/remaining
+// bookkeeping including the 0xFFFF-style zero-run escape (here decoded as
+// repeated 2-bit "3" fields, which is bit-for-bit the same thing) and the
+// previous0 2-bit run remainder. It returns the number of bytes of in that
+// the header occupied, so the caller can find the start of the payload that
+// follows it.
+func (s *Scratch) ReadNCount(in []byte) (int, error) {
+	if len(in) < 2 {
+		return 0, errors.New("fse: NCount header too small")
+	}
+	r := &headerReader{in: in}
+
+	v, err := r.readBits(4)
+	if err != nil {
+		return 0, err
+	}
+	tableLog := uint8(v) + minTablelog
+	if tableLog > maxTableLog {
+		return 0, fmt.Errorf("tableLog (%d) > maxTableLog (%d)", tableLog, maxTableLog)
+	}
+	s.actualTableLog = tableLog
+
+	for i := range s.norm {
+		s.norm[i] = 0
+	}
+
+	var (
+		tableSize = int32(1) << tableLog
+		remaining = tableSize + 1
+		threshold = tableSize
+		nbBits    = uint(tableLog) + 1
+		charnum   uint16
+		previous0 bool
+	)
+
+	for remaining > 1 && int(charnum) <= maxSymbolValue {
+		if previous0 {
+			for {
+				b, err := r.peekBits(2)
+				if err != nil {
+					return 0, err
+				}
+				if b != 3 {
+					break
+				}
+				r.bitPos += 2
+				charnum += 3
+			}
+			rem, err := r.readBits(2)
+			if err != nil {
+				return 0, err
+			}
+			charnum += uint16(rem)
+			if int(charnum) > maxSymbolValue {
+				return 0, errors.New("fse: NCount corrupt, charnum > maxSymbolValue")
+			}
+		}
+
+		max := (2*threshold - 1) - remaining
+		small, err := r.peekBits(nbBits - 1)
+		if err != nil {
+			return 0, err
+		}
+		var count int32
+		if int32(small) < max {
+			r.bitPos += int(nbBits - 1)
+			count = int32(small)
+		} else {
+			full, err := r.readBits(nbBits)
+			if err != nil {
+				return 0, err
+			}
+			count = int32(full)
+			if count >= threshold {
+				count -= max
+			}
+		}
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		if int(charnum) > maxSymbolValue {
+			return 0, errors.New("fse: NCount corrupt, too many symbols")
+		}
+		s.norm[charnum] = int16(count)
+		charnum++
+		previous0 = count == 0
+		if remaining < 1 {
+			return 0, errors.New("fse: NCount corrupt, remaining < 1")
+		}
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 {
+		return 0, errors.New("fse: NCount corrupt, did not end with remaining == 1")
+	}
+	s.symbolLen = charnum
+
+	return (r.bitPos + 7) / 8, nil
+}
+
+// buildDTable turns the normalized distribution in s.norm into a decoding
+// table of 1<<actualTableLog entries, spreading symbols in the same order
+// buildCTable does so the two stay in lock-step.
+func (s *Scratch) buildDTable() (*dTable, error) {
+	var cumul [maxSymbolValue + 2]int16
+	if err := s.spreadSymbols(&cumul); err != nil {
+		return nil, err
+	}
+
+	var symbolNext [maxSymbolValue + 1]uint16
+	for i, v := range s.norm[:s.symbolLen] {
+		if v == -1 {
+			symbolNext[i] = 1
+		} else {
+			symbolNext[i] = uint16(v)
+		}
+	}
+
+	tableSize := uint32(1) << s.actualTableLog
+	dt := &dTable{table: make([]decSymbol, tableSize)}
+	for u := uint32(0); u < tableSize; u++ {
+		sym := s.tableSymbol[u]
+		nextState := symbolNext[sym]
+		symbolNext[sym]++
+		nbBits := s.actualTableLog - uint8(bits.Len16(nextState)) + 1
+		dt.table[u] = decSymbol{
+			symbol:   sym,
+			nbBits:   nbBits,
+			newState: (nextState << nbBits) - uint16(tableSize),
+		}
+	}
+	return dt, nil
+}
+
+// bitReader reads the FSE payload bitstream written by encode. Because
+// encode walked its input back-to-front, this reads the buffer from its tail
+// backwards: it first locates the stop bit (the highest set bit of the last
+// byte), then consumes bits below it in reverse, which hands back symbols in
+// their original, forward order.
+type bitReader struct {
+	in       []byte
+	pos      int
+	bitsLeft int
+}
+
+func newBitReader(in []byte) (*bitReader, error) {
+	if len(in) == 0 {
+		return nil, errors.New("fse: empty FSE payload")
+	}
+	top := bits.Len8(in[len(in)-1])
+	if top == 0 {
+		return nil, errors.New("fse: missing stop bit")
+	}
+	total := 8*(len(in)-1) + top
+	return &bitReader{in: in, pos: total - 2, bitsLeft: total - 1}, nil
+}
+
+func (b *bitReader) getBits(n uint8) (uint16, error) {
+	if int(n) > b.bitsLeft {
+		return 0, errors.New("fse: FSE bitstream exhausted")
+	}
+	var v uint16
+	for i := 0; i < int(n); i++ {
+		bit := (b.in[b.pos/8] >> uint(b.pos%8)) & 1
+		v |= uint16(bit) << uint(int(n)-1-i)
+		b.pos--
+	}
+	b.bitsLeft -= int(n)
+	return v, nil
+}
+
+// decode reconstructs nOut original bytes from the FSE bitstream in br using
+// dt, the table built by buildDTable.
+func (s *Scratch) decode(br *bitReader, dt *dTable, nOut int) ([]byte, error) {
+	state, err := br.getBits(s.actualTableLog)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, nOut)
+	for i := 0; i < nOut; i++ {
+		entry := dt.table[state]
+		out[i] = entry.symbol
+		bitsVal, err := br.getBits(entry.nbBits)
+		if err != nil {
+			return nil, err
+		}
+		state = entry.newState + bitsVal
+	}
+	return out, nil
+}
+
+// Decompress reverses Compress: it reads the framing byte Compress wrote,
+// then either passes raw data through unchanged, replays an RLE block, or
+// parses the NCount header, builds a dTable and walks the FSE bitstream to
+// recover the original input.
+func Decompress(in []byte, s *Scratch) ([]byte, error) {
+	if len(in) < 1 {
+		return nil, errors.New("fse: empty input")
+	}
+	if s == nil {
+		s = &Scratch{}
+	}
+	mode := in[0]
+	in = in[1:]
+	switch mode {
+	case blockRaw:
+		out := make([]byte, len(in))
+		copy(out, in)
+		return out, nil
+	case blockRLE:
+		if len(in) < 5 {
+			return nil, errors.New("fse: RLE block too small")
+		}
+		n := int(in[0]) | int(in[1])<<8 | int(in[2])<<16 | int(in[3])<<24
+		if n > s.maxDecompressedSize() {
+			return nil, fmt.Errorf("fse: decompressed size %d exceeds limit %d", n, s.maxDecompressedSize())
+		}
+		out := make([]byte, n)
+		for i := range out {
+			out[i] = in[4]
+		}
+		return out, nil
+	case blockCompressed:
+		if len(in) < 4 {
+			return nil, errors.New("fse: compressed block too small")
+		}
+		n := int(in[0]) | int(in[1])<<8 | int(in[2])<<16 | int(in[3])<<24
+		if n > s.maxDecompressedSize() {
+			return nil, fmt.Errorf("fse: decompressed size %d exceeds limit %d", n, s.maxDecompressedSize())
+		}
+		in = in[4:]
+		headerSize, err := s.ReadNCount(in)
+		if err != nil {
+			return nil, err
+		}
+		dt, err := s.buildDTable()
+		if err != nil {
+			return nil, err
+		}
+		br, err := newBitReader(in[headerSize:])
+		if err != nil {
+			return nil, err
+		}
+		return s.decode(br, dt, n)
+	default:
+		return nil, fmt.Errorf("fse: unknown block mode %d", mode)
+	}
+}
@@ -35,12 +35,23 @@ type Scratch struct {
 	symbolLen      uint16
 	actualTableLog uint8
 
+	// tableSymbol is the scratch area used by buildCTable (and, later,
+	// buildDTable) to spread symbols across the table before the final
+	// cTable/dTable is assembled.
+	tableSymbol [maxTablesize]byte
+
 	// Out is output buffer
 	Out []byte
 
 	// Per block parameters
 	MaxSymbolValue uint8
 	TableLog       uint8
+
+	// MaxDecompressedSize bounds the output size Decompress will allocate
+	// for this Scratch. Zero means use defaultMaxDecompressedSize. Set
+	// this when the caller knows a tighter bound for the data it expects,
+	// since the decompressed size is read from the untrusted input.
+	MaxDecompressedSize int
 }
 
 func (s *Scratch) prepare(in []byte) (*Scratch, error) {
@@ -183,7 +194,7 @@ func (s *Scratch) writeCount() error {
 		tableLog  = s.actualTableLog
 		tableSize = 1 << tableLog
 		previous0 bool
-		charnum   uint8
+		charnum   uint16
 
 		maxHeaderSize = ((int(s.symbolLen) * int(tableLog)) >> 3) + 3
 
@@ -270,7 +281,7 @@ func (s *Scratch) writeCount() error {
 	out[outP+1] = byte(bitStream >> 8)
 	outP += (bitCount + 7) / 8
 
-	if uint16(charnum) > s.symbolLen {
+	if charnum > s.symbolLen {
 		return errors.New("internal error: charnum > s.symbolLen")
 	}
 	s.Out = out[:outP]
@@ -374,16 +385,206 @@ func (s *Scratch) normalizeCount2() error {
 	return nil
 }
 
+// tableStep returns the fixed FSE spread step for a table of the given size,
+// chosen so that repeated application visits every slot exactly once.
+func tableStep(tableSize uint32) uint32 {
+	return (tableSize >> 1) + (tableSize >> 3) + 3
+}
+
+// cStateTableOffset is the uint32 index, within s.cTable, of the first of the
+// tableSize/2 words holding the packed (2 per uint32) next-state table.
+const cStateTableOffset = 1
+
+// symbolTTOffset returns the uint32 index, within s.cTable, of the first of
+// the (MaxSymbolValue+1)*2 words holding the per-symbol deltaNbBits/
+// deltaFindState pairs.
+func (s *Scratch) symbolTTOffset() uint32 {
+	return cStateTableOffset + uint32(1<<(s.actualTableLog-1))
+}
+
+// setCState stores the next encoder state for spread-table slot idx.
+func (s *Scratch) setCState(idx uint32, v uint16) {
+	word := cStateTableOffset + idx/2
+	shift := (idx % 2) * 16
+	s.cTable[word] = (s.cTable[word] &^ (0xFFFF << shift)) | (uint32(v) << shift)
+}
+
+// getCState returns the next encoder state stored at spread-table slot idx.
+func (s *Scratch) getCState(idx uint32) uint16 {
+	word := cStateTableOffset + idx/2
+	shift := (idx % 2) * 16
+	return uint16(s.cTable[word] >> shift)
+}
+
+// setSymbolTT stores the deltaNbBits/deltaFindState pair used by encode to
+// advance the state when emitting sym.
+func (s *Scratch) setSymbolTT(sym int, deltaNbBits uint32, deltaFindState int32) {
+	off := s.symbolTTOffset() + uint32(sym)*2
+	s.cTable[off] = deltaNbBits
+	s.cTable[off+1] = uint32(deltaFindState)
+}
+
+// getSymbolTT returns the deltaNbBits/deltaFindState pair for sym.
+func (s *Scratch) getSymbolTT(sym byte) (deltaNbBits uint32, deltaFindState int32) {
+	off := s.symbolTTOffset() + uint32(sym)*2
+	return s.cTable[off], int32(s.cTable[off+1])
+}
+
+// spreadSymbols fills s.tableSymbol[:1<<actualTableLog] with the symbol that
+// owns each slot of the table, in the canonical FSE order: low-probability
+// (norm == -1) symbols are pinned to the top of the table, then every other
+// symbol is spread using the standard FSE step. cumul[sym] is left holding
+// the running per-symbol offset into the spread table, as required by both
+// buildCTable and buildDTable.
+func (s *Scratch) spreadSymbols(cumul *[maxSymbolValue + 2]int16) error {
+	tableSize := uint32(1) << s.actualTableLog
+	highThreshold := tableSize - 1
+
+	for i, v := range s.norm[:s.symbolLen] {
+		if v == -1 {
+			cumul[i+1] = cumul[i] + 1
+			s.tableSymbol[highThreshold] = byte(i)
+			highThreshold--
+		} else {
+			cumul[i+1] = cumul[i] + v
+		}
+	}
+	cumul[s.symbolLen] = int16(tableSize) + 1
+
+	tableMask := tableSize - 1
+	step := tableStep(tableSize)
+	position := uint32(0)
+	for i, v := range s.norm[:s.symbolLen] {
+		for n := int16(0); n < v; n++ {
+			s.tableSymbol[position] = byte(i)
+			position = (position + step) & tableMask
+			for position > highThreshold {
+				position = (position + step) & tableMask
+			}
+		}
+	}
+	if position != 0 {
+		return errors.New("internal error: position != 0 after spreading symbols")
+	}
+	return nil
+}
+
+// buildCTable turns the normalized distribution in s.norm into the encoding
+// table s.cTable: a packed next-state table (used to walk the state machine
+// forward) followed by a deltaNbBits/deltaFindState pair per symbol (used to
+// pick how many bits to emit and where the state moves to next).
+func (s *Scratch) buildCTable() error {
+	var cumul [maxSymbolValue + 2]int16
+	if err := s.spreadSymbols(&cumul); err != nil {
+		return err
+	}
+
+	tableSize := uint32(1) << s.actualTableLog
+	for u := uint32(0); u < tableSize; u++ {
+		sym := s.tableSymbol[u]
+		s.setCState(uint32(cumul[sym]), uint16(tableSize+u))
+		cumul[sym]++
+	}
+
+	total := int32(0)
+	maxBits := int32(s.actualTableLog) + 1
+	for i, v := range s.norm[:s.symbolLen] {
+		switch v {
+		case 0:
+			continue
+		case -1, 1:
+			s.setSymbolTT(i, (uint32(s.actualTableLog)<<16)-tableSize, total-1)
+			total++
+		default:
+			nbBits := uint8(maxBits) - uint8(bits.Len16(uint16(v-1)))
+			nextStateBaseline := uint32(v) << nbBits
+			s.setSymbolTT(i, (uint32(nbBits)<<16)-nextStateBaseline, total-int32(v))
+			total += int32(v)
+		}
+	}
+	return nil
+}
+
+// bitWriter is a small LSB-first bit packer: addBits appends the low 'bits'
+// bits of value, flushing whole bytes into out as soon as they are filled.
+type bitWriter struct {
+	bitContainer uint64
+	nBits        uint8
+	out          []byte
+}
+
+func (b *bitWriter) addBits(value uint16, bits uint8) {
+	if bits == 0 {
+		return
+	}
+	mask := uint64(1)<<bits - 1
+	b.bitContainer |= (uint64(value) & mask) << b.nBits
+	b.nBits += bits
+	for b.nBits >= 8 {
+		b.out = append(b.out, byte(b.bitContainer))
+		b.bitContainer >>= 8
+		b.nBits -= 8
+	}
+}
+
+// flush writes out any partially filled byte, so it must only be called once
+// the caller is done adding bits.
+func (b *bitWriter) flush() {
+	if b.nBits > 0 {
+		b.out = append(b.out, byte(b.bitContainer))
+		b.nBits = 0
+	}
+}
+
+// encode builds the cTable for the current distribution and appends the
+// FSE-encoded bitstream for in to s.Out.
+//
+// Input is walked in reverse so that the state flushed at the end of the
+// stream is the one produced by encoding in[0] last; Decompress reads the
+// bitstream from that same end backwards, which is what lets it recover the
+// symbols in their original order. The stream is terminated with a single
+// 1-bit stop marker, the top bit of the last byte, so the decoder can locate
+// where the real bits end.
+func (s *Scratch) encode(in []byte) error {
+	if err := s.buildCTable(); err != nil {
+		return err
+	}
+
+	var bw bitWriter
+	state := uint32(1) << s.actualTableLog
+	for i := len(in) - 1; i >= 0; i-- {
+		deltaNbBits, deltaFindState := s.getSymbolTT(in[i])
+		nbBits := uint8((state + deltaNbBits) >> 16)
+		bw.addBits(uint16(state), nbBits)
+		idx := int32(state>>nbBits) + deltaFindState
+		state = uint32(s.getCState(uint32(idx)))
+	}
+	bw.addBits(uint16(state), s.actualTableLog)
+	bw.addBits(1, 1)
+	bw.flush()
+
+	s.Out = append(s.Out, bw.out...)
+	return nil
+}
+
+// debugLog gates log's per-symbol table dump. It exists so the sanity check
+// below can run on every Compress call without spamming stdout by default.
+const debugLog = false
+
 func (s *Scratch) log() error {
 	var total int
-	fmt.Printf("selected TableLog: %d, Symbol length: %d\n", s.actualTableLog, s.symbolLen)
+	if debugLog {
+		fmt.Printf("selected TableLog: %d, Symbol length: %d\n", s.actualTableLog, s.symbolLen)
+	}
 	for i, v := range s.norm[:s.symbolLen] {
 		if v >= 0 {
 			total += int(v)
 		} else {
 			total -= int(v)
 		}
-		fmt.Printf("%3d: %5d -> %4d \n", i, s.count[i], v)
+		if debugLog {
+			fmt.Printf("%3d: %5d -> %4d \n", i, s.count[i], v)
+		}
 	}
 	if total != (1 << s.actualTableLog) {
 		return fmt.Errorf("warning: Total == %d != %d", total, 1<<s.actualTableLog)
@@ -411,13 +612,18 @@ func Compress(in []byte, s *Scratch) ([]byte, error) {
 	// Create histogram
 	maxCount := s.countSimple(in)
 	if maxCount == len(in) {
-		// One symbol, use RLE
-		// TODO: ???
+		// One symbol: store as a single-byte RLE block.
+		s.Out = append(s.Out[:0], blockRLE)
+		s.Out = appendUint32(s.Out, uint32(len(in)))
+		s.Out = append(s.Out, in[0])
+		return s.Out, nil
 	}
 	if maxCount == 1 || maxCount < (len(in)>>7) {
 		// Each symbol present maximum once or too well distributed.
-		// Uncompressible.
-		return nil, nil
+		// Uncompressible: store the input unchanged.
+		s.Out = append(s.Out[:0], blockRaw)
+		s.Out = append(s.Out, in...)
+		return s.Out, nil
 	}
 	s.optimalTableLog()
 	err = s.normalizeCount()
@@ -428,6 +634,24 @@ func Compress(in []byte, s *Scratch) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = s.encode(in)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.log(); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(s.Out)+5)
+	out = append(out, blockCompressed)
+	out = appendUint32(out, uint32(len(in)))
+	out = append(out, s.Out...)
+	s.Out = out
+
+	return s.Out, nil
+}
 
-	return s.Out, s.log()
+// appendUint32 appends v to dst as 4 little-endian bytes.
+func appendUint32(dst []byte, v uint32) []byte {
+	return append(dst, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
 }
@@ -0,0 +1,98 @@
+package fse
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func roundtrip(t *testing.T, in []byte) {
+	t.Helper()
+	var s Scratch
+	out, err := Compress(in, &s)
+	if err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	var d Scratch
+	got, err := Decompress(out, &d)
+	if err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+	if !bytes.Equal(got, in) {
+		t.Fatalf("roundtrip mismatch: in %d bytes, got %d bytes", len(in), len(got))
+	}
+}
+
+func TestRoundtripSkewed(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// Skewed distribution so it is compressible.
+	var in []byte
+	for i := 0; i < 10000; i++ {
+		r := rng.Intn(100)
+		switch {
+		case r < 50:
+			in = append(in, 'a')
+		case r < 80:
+			in = append(in, 'b')
+		case r < 95:
+			in = append(in, 'c')
+		default:
+			in = append(in, byte(rng.Intn(32)))
+		}
+	}
+	roundtrip(t, in)
+}
+
+func TestRoundtripRLE(t *testing.T) {
+	in := bytes.Repeat([]byte{'x'}, 500)
+	roundtrip(t, in)
+}
+
+func TestRoundtripRaw(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	// Every byte value exactly once, so Compress stores it raw.
+	in := make([]byte, 256)
+	for i, v := range rng.Perm(256) {
+		in[i] = byte(v)
+	}
+	roundtrip(t, in)
+}
+
+func TestRoundtripText(t *testing.T) {
+	in := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 200)
+	roundtrip(t, in)
+}
+
+func TestDecompressRejectsOversizedRLE(t *testing.T) {
+	in := []byte{blockRLE, 0xFF, 0xFF, 0xFF, 0x7F, 'z'}
+	var s Scratch
+	if _, err := Decompress(in, &s); err == nil {
+		t.Fatal("expected error for oversized RLE length, got nil")
+	}
+}
+
+func TestDecompressRejectsOversizedCompressed(t *testing.T) {
+	in := make([]byte, 30)
+	in[0] = blockCompressed
+	in[1], in[2], in[3], in[4] = 0xFF, 0xFF, 0xFF, 0xFF
+	var s Scratch
+	if _, err := Decompress(in, &s); err == nil {
+		t.Fatal("expected error for oversized compressed length, got nil")
+	}
+}
+
+func TestRoundtripFullAlphabet(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	// Skewed toward a handful of values but drawing from almost the full
+	// byte range, so writeCount's zero-run escape has to walk charnum up
+	// near maxSymbolValue.
+	var in []byte
+	for i := 0; i < 1023; i++ {
+		if rng.Intn(100) < 19 {
+			in = append(in, byte(rng.Intn(3)))
+		} else {
+			in = append(in, byte(rng.Intn(252)))
+		}
+	}
+	roundtrip(t, in)
+}